@@ -18,101 +18,95 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"io"
 	"io/ioutil"
-	"log"
-	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/go-hclog"
 )
 
 const IRONIC_API_VERSION = "v1"
-const LOOKUP_PAYLOAD_VERSION = "2"
-
-var DEBUG = false
 
-type LookupPayload struct {
-	Version   string            `json:"version"`
-	Inventory HardwareInventory `json:"inventory"`
+// ClientOptions configures the retry policies used by IronicAPIClient.
+// Lookup and heartbeat get separate policies because they have different
+// failure semantics: lookup must eventually succeed for the agent to make
+// any progress at all, while heartbeat should give up after a bounded time
+// so the agent doesn't hang forever on a node Ironic has stopped tracking.
+type ClientOptions struct {
+	// InitialBackoff is the starting interval between retries. Subsequent
+	// intervals grow exponentially with jitter.
+	InitialBackoff time.Duration
+
+	// LookupMaxElapsedTime bounds how long Lookup will keep retrying. Zero
+	// means retry forever.
+	LookupMaxElapsedTime time.Duration
+
+	// HeartbeatMaxElapsedTime bounds how long Heartbeat will keep retrying
+	// a single heartbeat call before giving up with an error.
+	HeartbeatMaxElapsedTime time.Duration
 }
 
-type HardwareInventory struct {
-	Interfaces []InterfaceInfo `json:"interfaces"`
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		InitialBackoff:          500 * time.Millisecond,
+		LookupMaxElapsedTime:    0,
+		HeartbeatMaxElapsedTime: 2 * time.Minute,
+	}
 }
 
-type InterfaceInfo struct {
-	Name       string `json:"name"`
-	MacAddress string `json:"mac_address"`
+type IronicAPIClient struct {
+	URL           string
+	DriverName    string
+	client        *http.Client
+	options       ClientOptions
+	logger        hclog.Logger
+	authenticator Authenticator
 }
 
-func InterfaceIsDevice(iface net.Interface) (bool, error) {
-	_, err := os.Stat("/sys/class/net/" + iface.Name + "/device")
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		} else {
-			return false, err
-		}
-	} else {
-		return true, nil
+func NewAPIClient(url string, driverName string, options ClientOptions, tlsConfig TLSConfig, authenticator Authenticator, logger hclog.Logger) (*IronicAPIClient, error) {
+	// Canonicalize the URL to have a trailing slash, just because
+	if !strings.HasSuffix(url, "/") {
+		url = url + "/"
 	}
-}
-
-func BuildLookupPayload() (*LookupPayload, error) {
-	interfaces, err := net.Interfaces()
 
+	tc, err := tlsConfig.Build()
 	if err != nil {
 		return nil, err
 	}
 
-	interfaceInfos := make([]InterfaceInfo, 0)
-
-	for _, iface := range interfaces {
-		isDevice, err := InterfaceIsDevice(iface)
-		if err != nil {
-			return nil, err
-		}
-
-		if isDevice {
-			interfaceInfos = append(interfaceInfos, InterfaceInfo{
-				Name:       iface.Name,
-				MacAddress: iface.HardwareAddr.String(),
-			})
-		}
-	}
-
-	payload := &LookupPayload{
-		Version: LOOKUP_PAYLOAD_VERSION,
-		Inventory: HardwareInventory{
-			Interfaces: interfaceInfos,
-		},
+	if authenticator == nil {
+		authenticator = noneAuthenticator{}
 	}
 
-	return payload, nil
-}
-
-type IronicAPIClient struct {
-	URL        string
-	DriverName string
-	client     *http.Client
+	return &IronicAPIClient{
+		URL:           url,
+		DriverName:    driverName,
+		client:        &http.Client{Transport: &http.Transport{TLSClientConfig: tc}},
+		options:       options,
+		logger:        logger,
+		authenticator: authenticator,
+	}, nil
 }
 
-func NewAPIClient(url string, driverName string) *IronicAPIClient {
-	// Canonicalize the URL to have a trailing slash, just because
-	if !strings.HasSuffix(url, "/") {
-		url = url + "/"
-	}
-
-	return &IronicAPIClient{
-		URL:        url,
-		DriverName: driverName,
-		client:     &http.Client{},
+// isRetryableStatus reports whether an HTTP response with the given status
+// code represents a transient failure worth retrying. 5xx, 429 (Too Many
+// Requests) and 408 (Request Timeout) are retryable; all other 4xx codes
+// are permanent failures.
+func isRetryableStatus(statusCode int) bool {
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout {
+		return true
 	}
+	return statusCode >= 500
 }
 
 type IronicNode struct {
@@ -127,7 +121,7 @@ type LookupResponse struct {
 	Node IronicNode `json:"node"`
 }
 
-func (c *IronicAPIClient) do(method string, path string, body interface{}) (*http.Response, error) {
+func (c *IronicAPIClient) do(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
 	var bodyReader io.Reader
 	if body != nil {
 		bodyBytes, err := json.Marshal(body)
@@ -137,7 +131,7 @@ func (c *IronicAPIClient) do(method string, path string, body interface{}) (*htt
 		bodyReader = bytes.NewReader(bodyBytes)
 	}
 
-	req, err := http.NewRequest(method, c.URL+IRONIC_API_VERSION+path, bodyReader)
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+IRONIC_API_VERSION+path, bodyReader)
 
 	if err != nil {
 		return nil, err
@@ -149,18 +143,77 @@ func (c *IronicAPIClient) do(method string, path string, body interface{}) (*htt
 
 	req.Header.Add("Accept", "application/json")
 
+	if err := c.authenticator.Authorize(ctx, req); err != nil {
+		return nil, err
+	}
+
 	return c.client.Do(req)
 }
 
-func (c *IronicAPIClient) Lookup(payload *LookupPayload) (*IronicNode, error) {
-	res, err := c.do("POST", "/drivers/"+c.DriverName+"/vendor_passthru/lookup", payload)
-	if err != nil {
-		return nil, err
+// doRetrying wraps do in an exponential backoff-with-jitter retry loop.
+// Connection errors, 5xx responses and 429s are retried; any other
+// non-matching status is treated as a permanent failure and returned
+// immediately. maxElapsedTime bounds the total retry budget; zero means
+// retry indefinitely. The retry loop also stops as soon as ctx is
+// cancelled or its deadline passes, whichever comes first.
+func (c *IronicAPIClient) doRetrying(ctx context.Context, method string, path string, body interface{}, expectedStatus int, maxElapsedTime time.Duration) (*http.Response, error) {
+	var res *http.Response
+	attempt := 0
+
+	operation := func() error {
+		attempt++
+		start := time.Now()
+
+		var err error
+		res, err = c.do(ctx, method, path, body)
+		duration := time.Since(start)
+		if err != nil {
+			c.logger.Warn("http request failed", "method", method, "path", path, "duration", duration, "retry_attempt", attempt, "error", err)
+			return err
+		}
+
+		c.logger.Debug("http request completed", "method", method, "path", path, "status", res.StatusCode, "duration", duration, "retry_attempt", attempt)
+		if res.StatusCode == expectedStatus {
+			return nil
+		}
+
+		// This response won't be read by the caller (we're about to retry
+		// or fail outright), so drain and close it now rather than
+		// leaking the connection.
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+
+		statusErr := errors.New("Unexpected response from Ironic: " + res.Status)
+
+		if res.StatusCode == http.StatusUnauthorized {
+			if reauthErr := c.authenticator.Reauthorize(ctx); reauthErr != nil {
+				return backoff.Permanent(statusErr)
+			}
+			return statusErr
+		}
+
+		if !isRetryableStatus(res.StatusCode) {
+			return backoff.Permanent(statusErr)
+		}
+		return statusErr
 	}
 
-	// TODO: Some kind of retry
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New("Unexpected response from Ironic lookup call: " + res.Status)
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = c.options.InitialBackoff
+	bo.MaxElapsedTime = maxElapsedTime
+
+	err := backoff.RetryNotify(operation, backoff.WithContext(bo, ctx), func(err error, next time.Duration) {
+		c.logger.Info("retrying Ironic request", "method", method, "path", path, "retry_attempt", attempt, "next_delay", next, "error", err)
+	})
+	return res, err
+}
+
+// LookupCtx calls the Ironic lookup vendor_passthru endpoint, retrying
+// until it succeeds, ctx is done, or the lookup retry budget is spent.
+func (c *IronicAPIClient) LookupCtx(ctx context.Context, payload *LookupPayload) (*IronicNode, error) {
+	res, err := c.doRetrying(ctx, "POST", "/drivers/"+c.DriverName+"/vendor_passthru/lookup", payload, http.StatusOK, c.options.LookupMaxElapsedTime)
+	if err != nil {
+		return nil, err
 	}
 
 	defer res.Body.Close()
@@ -177,99 +230,207 @@ func (c *IronicAPIClient) Lookup(payload *LookupPayload) (*IronicNode, error) {
 	return &lookupResponse.Node, nil
 }
 
-func (c *IronicAPIClient) Heartbeat(uuid string) error {
+// HeartbeatCtx sends a single heartbeat for uuid, retrying until it
+// succeeds, ctx is done, or the heartbeat retry budget is spent. Ironic
+// expects heartbeats periodically for the life of the rescue flow, not
+// just once; see runHeartbeatLoop for the caller that provides that.
+func (c *IronicAPIClient) HeartbeatCtx(ctx context.Context, uuid string) error {
 	payload := map[string]string{
 		"agent_url": "",
 	}
 
-	res, err := c.do("POST", "/nodes/"+uuid+"/vendor_passthru/heartbeat", payload)
-	if err != nil {
-		return err
+	res, err := c.doRetrying(ctx, "POST", "/nodes/"+uuid+"/vendor_passthru/heartbeat", payload, http.StatusAccepted, c.options.HeartbeatMaxElapsedTime)
+	if res != nil {
+		res.Body.Close()
 	}
+	return err
+}
 
-	// TODO: Some kind of retry
-	if res.StatusCode != http.StatusAccepted {
-		return errors.New("Unexpected response from Ironic heartbeat call: " + res.Status)
+// runHeartbeatLoop sends an immediate heartbeat and then one every
+// interval until ctx is done (finalization completed or the overall
+// deadline fired). A single heartbeat's own failure, after its retry
+// budget is spent, is logged and does not stop the loop; Ironic will
+// simply see a gap and the next tick tries again.
+func runHeartbeatLoop(ctx context.Context, c *IronicAPIClient, uuid string, interval time.Duration, timeout time.Duration, logger hclog.Logger) {
+	heartbeatOnce := func() {
+		callCtx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := c.HeartbeatCtx(callCtx, uuid); err != nil {
+			logger.Warn("heartbeat failed", "error", err)
+		}
 	}
 
-	return nil
-}
+	heartbeatOnce()
 
-func FinalizeRescue(finalizeScript string, configDrive string, rescueUsername string, rescueHash string) error {
-	var out bytes.Buffer
-	cmd := exec.Command(finalizeScript, rescueUsername, rescueHash)
-	cmd.Stdin = strings.NewReader(configDrive)
-	cmd.Stdout = &out
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			heartbeatOnce()
+		}
+	}
 }
 
-func ParseKernelArgs(kernelArgsFile string) map[string]string {
+func ParseKernelArgs(logger hclog.Logger, kernelArgsFile string) map[string]string {
 	argsBytes, err := ioutil.ReadFile(kernelArgsFile)
 	if err != nil {
-		log.Fatal("Error opening kernel args file: ", err)
+		logger.Error("error opening kernel args file", "kernel_args_file", kernelArgsFile, "error", err)
+		os.Exit(1)
 	}
 	kernelArgs := make(map[string]string)
 	for _, argField := range strings.Fields(string(argsBytes)) {
 		split := strings.SplitN(argField, "=", 2)
+		if len(split) != 2 {
+			// Bare flag (e.g. "ro", "quiet") with no value; nothing to
+			// record.
+			continue
+		}
 		kernelArgs[split[0]] = split[1]
 	}
-	if DEBUG {
-		log.Print("Parsed kernel args: ", kernelArgs)
-	}
+	logger.Debug("parsed kernel args", "kernel_args", kernelArgs)
 	return kernelArgs
 }
 
 func main() {
 	var apiURL string
-	var finalizeScript string
 	var rescueUsername string
 	var kernelArgsFile string
+	var logLevel string
+	var logFormat string
+	var rescueDriverName string
+	var lookupTimeout time.Duration
+	var heartbeatTimeout time.Duration
+	var heartbeatInterval time.Duration
+	var overallDeadline time.Duration
+	rescueDriverOpts := make(driverOpts)
+	clientOptions := DefaultClientOptions()
 
-	flag.BoolVar(&DEBUG, "debug", false, "Debug mode")
 	flag.StringVar(&apiURL, "api-url-override", "", "Ironic API URL")
-	flag.StringVar(&finalizeScript, "finalize-script", "/usr/local/bin/finalize_rescue.bash", "Run this script as the final step")
 	flag.StringVar(&rescueUsername, "rescue-username", "rescue", "Rescue mode username")
 	flag.StringVar(&kernelArgsFile, "kernel-args-file", "/proc/cmdline", "File containing kernel command line arguments")
+	flag.DurationVar(&clientOptions.InitialBackoff, "initial-backoff", clientOptions.InitialBackoff, "Initial interval between Ironic API retries")
+	flag.DurationVar(&clientOptions.LookupMaxElapsedTime, "lookup-max-elapsed", clientOptions.LookupMaxElapsedTime, "Max total time to retry the lookup call; 0 retries forever")
+	flag.DurationVar(&clientOptions.HeartbeatMaxElapsedTime, "heartbeat-max-elapsed", clientOptions.HeartbeatMaxElapsedTime, "Max total time to retry a single heartbeat call")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level (trace|debug|info|warn|error)")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format (text|json)")
+	flag.StringVar(&rescueDriverName, "rescue-driver", "script", "Rescue finalize driver to use (script|cloud-init|chroot-useradd|test)")
+	flag.Var(rescueDriverOpts, "rescue-driver-opt", "Driver-specific option in key=value form; may be repeated")
+	flag.DurationVar(&lookupTimeout, "lookup-timeout", 0, "Deadline for the whole lookup call, including retries; 0 means no deadline")
+	flag.DurationVar(&heartbeatTimeout, "heartbeat-timeout", 30*time.Second, "Deadline for a single heartbeat call, including retries; 0 means no deadline")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 30*time.Second, "Interval between heartbeats sent to Ironic")
+	flag.DurationVar(&overallDeadline, "overall-deadline", 0, "Deadline for the entire rescue flow; 0 means no deadline")
+	inventoryOptions := InventoryOptions{}
+	flag.BoolVar(&inventoryOptions.CollectDisks, "collect-disks", false, "Collect per-disk inventory from /sys/block (walks every block device)")
+	flag.BoolVar(&inventoryOptions.CollectLLDP, "collect-lldp", false, "Collect LLDP neighbor data via lldpctl, when present")
+	var tlsConfig TLSConfig
+	flag.StringVar(&tlsConfig.CAFile, "ca-file", "", "PEM CA bundle to verify the Ironic API server against")
+	flag.StringVar(&tlsConfig.ClientCert, "client-cert", "", "PEM client certificate for mTLS")
+	flag.StringVar(&tlsConfig.ClientKey, "client-key", "", "PEM client key for mTLS")
+	flag.BoolVar(&tlsConfig.InsecureSkipVerify, "insecure-skip-verify", false, "Skip Ironic API server certificate verification")
+	var authMode string
+	var tokenFile string
+	var keystoneURL string
+	var keystoneUser string
+	var keystonePassword string
+	flag.StringVar(&authMode, "auth-mode", "none", "Ironic API auth mode (none|bearer|keystone)")
+	flag.StringVar(&tokenFile, "token-file", "", "File containing a bearer token, for -auth-mode=bearer")
+	flag.StringVar(&keystoneURL, "keystone-url", "", "Keystone URL, for -auth-mode=keystone")
+	flag.StringVar(&keystoneUser, "keystone-user", "", "Keystone username, for -auth-mode=keystone")
+	flag.StringVar(&keystonePassword, "keystone-password", "", "Keystone password, for -auth-mode=keystone")
 	flag.Parse()
 
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:       "onmetal-rescue-agent",
+		Level:      hclog.LevelFromString(logLevel),
+		JSONFormat: logFormat == "json",
+	})
+
+	rootCtx, stopSignalWait := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignalWait()
+
+	ctx := rootCtx
+	if overallDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(rootCtx, overallDeadline)
+		defer cancel()
+	}
+
+	var kernelArgs map[string]string
+	needKernelArgs := apiURL == "" || (authMode == "bearer" && tokenFile == "") || authMode == "keystone"
+	if needKernelArgs {
+		kernelArgs = ParseKernelArgs(logger, kernelArgsFile)
+	}
 	if apiURL == "" {
-		kernelArgs := ParseKernelArgs(kernelArgsFile)
 		apiURL = kernelArgs["ipa-api-url"]
 	}
 
 	if apiURL == "" {
-		log.Fatal("Unable to determine Ironic API URL")
+		logger.Error("unable to determine Ironic API URL")
+		os.Exit(1)
 	}
 
-	c := NewAPIClient(apiURL, "agent_ipmitool")
+	rescueDriver, err := GetDriver(rescueDriverName)
+	if err != nil {
+		logger.Error("error selecting rescue driver", "error", err)
+		os.Exit(1)
+	}
+	if err := rescueDriver.Validate(rescueDriverOpts); err != nil {
+		logger.Error("invalid rescue driver options", "rescue_driver", rescueDriverName, "error", err)
+		os.Exit(1)
+	}
 
-	payload, err := BuildLookupPayload()
+	authenticator, err := buildAuthenticator(authMode, tokenFile, kernelArgs, keystoneURL, keystoneUser, keystonePassword, tlsConfig)
 	if err != nil {
-		log.Fatal("Error building lookup payload: ", err)
+		logger.Error("invalid auth configuration", "auth_mode", authMode, "error", err)
+		os.Exit(1)
 	}
-	if DEBUG {
-		log.Print(payload)
+
+	c, err := NewAPIClient(apiURL, "agent_ipmitool", clientOptions, tlsConfig, authenticator, logger.With("component", "http"))
+	if err != nil {
+		logger.Error("error building Ironic API client", "error", err)
+		os.Exit(1)
 	}
 
-	node, err := c.Lookup(payload)
+	lookupLogger := logger.With("component", "lookup")
+	payload, err := BuildLookupPayload(lookupLogger, inventoryOptions)
 	if err != nil {
-		log.Fatal("Error in lookup call: ", err)
+		logger.Error("error building lookup payload", "error", err)
+		os.Exit(1)
 	}
-	if DEBUG {
-		log.Print(node.UUID)
-		log.Print(node.InstanceInfo.ConfigDrive)
-		log.Print(node.InstanceInfo.RescuePasswordHash)
+
+	lookupCtx := ctx
+	if lookupTimeout > 0 {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, lookupTimeout)
+		defer cancel()
 	}
 
-	err = c.Heartbeat(node.UUID)
+	node, err := c.LookupCtx(lookupCtx, payload)
 	if err != nil {
-		log.Fatal("Error in heartbeat: ", err)
+		logger.Error("error in lookup call", "error", err)
+		os.Exit(1)
 	}
+	lookupLogger.Debug("lookup succeeded", "node_uuid", node.UUID)
+
+	heartbeatLogger := logger.With("component", "heartbeat")
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go runHeartbeatLoop(heartbeatCtx, c, node.UUID, heartbeatInterval, heartbeatTimeout, heartbeatLogger)
 
-	err = FinalizeRescue(finalizeScript, node.InstanceInfo.ConfigDrive, rescueUsername, node.InstanceInfo.RescuePasswordHash)
+	finalizeLogger := logger.With("component", "finalize")
+	finalizeLogger.Info("finalizing rescue", "rescue_driver", rescueDriverName, "rescue_username", rescueUsername)
+	err = rescueDriver.Apply(ctx, node, rescueUsername)
+	stopHeartbeat()
 	if err != nil {
-		log.Fatal("Error with finalize: ", err)
+		finalizeLogger.Error("error applying rescue driver", "rescue_driver", rescueDriverName, "error", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,274 @@
+/**
+ * Copyright 2014 Rackspace, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TLSConfig configures the transport IronicAPIClient talks over. It is
+// unused (a bare *http.Client{}) by default, which only works against a
+// plain-HTTP Ironic; production deployments behind Keystone/HTTPS need at
+// least CAFile, and mTLS deployments also need ClientCert/ClientKey.
+type TLSConfig struct {
+	CAFile             string
+	ClientCert         string
+	ClientKey          string
+	InsecureSkipVerify bool
+}
+
+// Build turns TLSConfig into a *tls.Config suitable for an http.Transport.
+// A zero-value TLSConfig produces the stdlib default TLS behavior.
+func (t TLSConfig) Build() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+
+	if t.CAFile != "" {
+		caCert, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificates found in -ca-file")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if t.ClientCert != "" || t.ClientKey != "" {
+		if t.ClientCert == "" || t.ClientKey == "" {
+			return nil, errors.New("-client-cert and -client-key must both be set for mTLS")
+		}
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// Authenticator attaches credentials to outgoing Ironic API requests.
+// Implementations must never log the credential material they hold; only
+// IronicAPIClient's structured fields (method, path, status, ...) are
+// logged, and authenticators should keep it that way.
+type Authenticator interface {
+	// Authorize sets whatever headers are needed on req before it is sent.
+	Authorize(ctx context.Context, req *http.Request) error
+
+	// Reauthorize is called after a 401 response, to refresh cached
+	// credentials before doRetrying retries the request. It returns an
+	// error if the credentials cannot be refreshed, in which case the 401
+	// is treated as a permanent failure.
+	Reauthorize(ctx context.Context) error
+}
+
+// noneAuthenticator is the default (-auth-mode=none): no Authorization
+// header is added, matching the agent's original behavior.
+type noneAuthenticator struct{}
+
+func (noneAuthenticator) Authorize(ctx context.Context, req *http.Request) error { return nil }
+
+func (noneAuthenticator) Reauthorize(ctx context.Context) error {
+	return errors.New("no authenticator configured, cannot reauthorize after a 401")
+}
+
+// bearerAuthenticator (-auth-mode=bearer) sends a single static token read
+// once at startup. The token cannot be refreshed, so a 401 is always
+// permanent.
+type bearerAuthenticator struct {
+	token string
+}
+
+func (a *bearerAuthenticator) Authorize(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+func (a *bearerAuthenticator) Reauthorize(ctx context.Context) error {
+	return errors.New("bearer token is static and cannot be refreshed")
+}
+
+// keystoneAuthenticator (-auth-mode=keystone) exchanges credentials for a
+// Keystone token, caches it, and fetches a fresh one on Reauthorize (i.e.
+// after a 401).
+type keystoneAuthenticator struct {
+	keystoneURL   string
+	username      string
+	password      string
+	appCredID     string
+	appCredSecret string
+	client        *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+func (a *keystoneAuthenticator) Authorize(ctx context.Context, req *http.Request) error {
+	token, err := a.ensureToken(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	return nil
+}
+
+func (a *keystoneAuthenticator) Reauthorize(ctx context.Context) error {
+	a.mu.Lock()
+	a.token = ""
+	a.mu.Unlock()
+
+	_, err := a.ensureToken(ctx)
+	return err
+}
+
+func (a *keystoneAuthenticator) ensureToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" {
+		return a.token, nil
+	}
+
+	token, err := a.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	a.token = token
+	return token, nil
+}
+
+func (a *keystoneAuthenticator) requestToken(ctx context.Context) (string, error) {
+	var identity map[string]interface{}
+	if a.appCredID != "" {
+		identity = map[string]interface{}{
+			"methods": []string{"application_credential"},
+			"application_credential": map[string]interface{}{
+				"id":     a.appCredID,
+				"secret": a.appCredSecret,
+			},
+		}
+	} else {
+		identity = map[string]interface{}{
+			"methods": []string{"password"},
+			"password": map[string]interface{}{
+				"user": map[string]interface{}{
+					"name":     a.username,
+					"password": a.password,
+					"domain":   map[string]interface{}{"name": "Default"},
+				},
+			},
+		}
+	}
+
+	authRequest := map[string]interface{}{
+		"auth": map[string]interface{}{"identity": identity},
+	}
+
+	bodyBytes, err := json.Marshal(authRequest)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", a.keystoneURL+"/v3/auth/tokens", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("keystone authentication failed: %s", res.Status)
+	}
+
+	token := res.Header.Get("X-Subject-Token")
+	if token == "" {
+		return "", errors.New("keystone response did not include an X-Subject-Token header")
+	}
+	return token, nil
+}
+
+// buildAuthenticator constructs the Authenticator selected by authMode.
+// Bearer tokens and keystone application credentials fall back to kernel
+// args (ipa-api-token, ipa-keystone-app-credential-id/secret) when the
+// corresponding flag isn't set, matching how the agent already learns the
+// Ironic API URL. tlsConfig is the same TLSConfig used to build the Ironic
+// API client, so a keystone authenticator talks to Keystone over the same
+// CA/mTLS settings rather than a bare default transport.
+func buildAuthenticator(authMode string, tokenFile string, kernelArgs map[string]string, keystoneURL string, keystoneUser string, keystonePassword string, tlsConfig TLSConfig) (Authenticator, error) {
+	switch authMode {
+	case "", "none":
+		return noneAuthenticator{}, nil
+
+	case "bearer":
+		token := kernelArgs["ipa-api-token"]
+		if tokenFile != "" {
+			contents, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading -token-file: %w", err)
+			}
+			token = strings.TrimSpace(string(contents))
+		}
+		if token == "" {
+			return nil, errors.New("-auth-mode=bearer requires -token-file or an ipa-api-token kernel arg")
+		}
+		return &bearerAuthenticator{token: token}, nil
+
+	case "keystone":
+		if keystoneURL == "" {
+			return nil, errors.New("-auth-mode=keystone requires -keystone-url")
+		}
+
+		appCredID := kernelArgs["ipa-keystone-app-credential-id"]
+		appCredSecret := kernelArgs["ipa-keystone-app-credential-secret"]
+		if appCredID == "" && (keystoneUser == "" || keystonePassword == "") {
+			return nil, errors.New("-auth-mode=keystone requires -keystone-user/-keystone-password or an application-credential kernel arg pair")
+		}
+
+		tc, err := tlsConfig.Build()
+		if err != nil {
+			return nil, err
+		}
+
+		return &keystoneAuthenticator{
+			keystoneURL:   keystoneURL,
+			username:      keystoneUser,
+			password:      keystonePassword,
+			appCredID:     appCredID,
+			appCredSecret: appCredSecret,
+			client:        &http.Client{Transport: &http.Transport{TLSClientConfig: tc}},
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", authMode)
+	}
+}
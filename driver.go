@@ -0,0 +1,88 @@
+/**
+ * Copyright 2014 Rackspace, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RescueDriver performs the final provisioning step of the rescue flow:
+// taking the node Ironic handed back from Lookup and turning it into an
+// accessible rescue environment (creating a user, loading the configdrive,
+// etc). Drivers register themselves at init time via RegisterDriver so
+// that downstream forks can add their own without patching main.
+type RescueDriver interface {
+	// Name is the identifier used to select this driver via -rescue-driver.
+	Name() string
+
+	// Validate checks driver-specific options supplied via repeated
+	// -rescue-driver-opt key=value flags and stores whatever the driver
+	// needs out of them. It is called once, after flag parsing and before
+	// Apply.
+	Validate(opts map[string]string) error
+
+	// Apply finalizes rescue mode for node, creating rescueUsername with
+	// the password hash Ironic supplied.
+	Apply(ctx context.Context, node *IronicNode, rescueUsername string) error
+}
+
+var driverRegistry = make(map[string]RescueDriver)
+
+// RegisterDriver adds a driver to the registry under its Name(). Call it
+// from a driver's init() function. It panics on a duplicate name, since
+// that indicates two drivers compiled into the same binary claim the same
+// identifier, which is a programming error rather than a runtime one.
+func RegisterDriver(d RescueDriver) {
+	name := d.Name()
+	if _, exists := driverRegistry[name]; exists {
+		panic("rescue driver already registered: " + name)
+	}
+	driverRegistry[name] = d
+}
+
+// GetDriver looks up a registered driver by name.
+func GetDriver(name string) (RescueDriver, error) {
+	d, ok := driverRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rescue driver %q", name)
+	}
+	return d, nil
+}
+
+// driverOpts collects repeated -rescue-driver-opt key=value flags into a
+// map suitable for RescueDriver.Validate.
+type driverOpts map[string]string
+
+func (o driverOpts) String() string {
+	pairs := make([]string, 0, len(o))
+	for k, v := range o {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (o driverOpts) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("rescue-driver-opt must be in key=value form, got: " + value)
+	}
+	o[parts[0]] = parts[1]
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+func init() {
+	RegisterDriver(&chrootUseraddDriver{})
+}
+
+// chrootUseraddDriver creates the rescue user directly inside the target
+// root filesystem via chroot, without shelling out to an external finalize
+// script or relying on cloud-init being present there.
+type chrootUseraddDriver struct {
+	targetRoot string
+}
+
+func (d *chrootUseraddDriver) Name() string { return "chroot-useradd" }
+
+func (d *chrootUseraddDriver) Validate(opts map[string]string) error {
+	d.targetRoot = opts["target-root"]
+	if d.targetRoot == "" {
+		d.targetRoot = "/mnt"
+	}
+	return nil
+}
+
+func (d *chrootUseraddDriver) Apply(ctx context.Context, node *IronicNode, rescueUsername string) error {
+	useradd := exec.CommandContext(ctx, "chroot", d.targetRoot, "useradd", "-m", "-p", node.InstanceInfo.RescuePasswordHash, rescueUsername)
+	if out, err := useradd.CombinedOutput(); err != nil {
+		return fmt.Errorf("creating rescue user: %w: %s", err, out)
+	}
+	return nil
+}
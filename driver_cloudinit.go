@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+func init() {
+	RegisterDriver(&cloudInitDriver{})
+}
+
+// cloudInitDriver writes the Ironic configdrive to a loopback ISO9660
+// filesystem and invokes cloud-init against it directly, without
+// delegating to an external finalize script. The rescue password hash is
+// expected to already be present in the configdrive's cloud-init user-data
+// (Ironic's standard configdrive layout), so this driver's job is only to
+// make that data visible to cloud-init and run it.
+type cloudInitDriver struct {
+	mountDir string
+}
+
+func (d *cloudInitDriver) Name() string { return "cloud-init" }
+
+func (d *cloudInitDriver) Validate(opts map[string]string) error {
+	d.mountDir = opts["mount-dir"]
+	if d.mountDir == "" {
+		d.mountDir = "/mnt/configdrive"
+	}
+	return nil
+}
+
+func (d *cloudInitDriver) Apply(ctx context.Context, node *IronicNode, rescueUsername string) error {
+	configDriveBytes, err := base64.StdEncoding.DecodeString(node.InstanceInfo.ConfigDrive)
+	if err != nil {
+		return fmt.Errorf("decoding configdrive: %w", err)
+	}
+
+	isoFile, err := ioutil.TempFile("", "configdrive-*.iso")
+	if err != nil {
+		return err
+	}
+	isoPath := isoFile.Name()
+	defer os.Remove(isoPath)
+
+	if _, err := isoFile.Write(configDriveBytes); err != nil {
+		isoFile.Close()
+		return err
+	}
+	if err := isoFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(d.mountDir, 0755); err != nil {
+		return err
+	}
+
+	mount := exec.CommandContext(ctx, "mount", "-o", "loop,ro", isoPath, d.mountDir)
+	if out, err := mount.CombinedOutput(); err != nil {
+		return fmt.Errorf("mounting configdrive iso: %w: %s", err, out)
+	}
+	defer exec.Command("umount", d.mountDir).Run()
+
+	cloudInit := exec.CommandContext(ctx, "cloud-init", "single", "--name", "cc_users_groups", "--frequency", "always")
+	cloudInit.Stdout = os.Stdout
+	cloudInit.Stderr = os.Stderr
+	return cloudInit.Run()
+}
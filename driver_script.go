@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	RegisterDriver(&scriptDriver{})
+}
+
+// scriptDriver shells out to an external finalize script, passing the
+// rescue username and password hash as arguments and the configdrive
+// contents on stdin. This is the agent's original, pre-driver-registry
+// behavior, kept as the default driver.
+type scriptDriver struct {
+	path string
+}
+
+func (d *scriptDriver) Name() string { return "script" }
+
+func (d *scriptDriver) Validate(opts map[string]string) error {
+	d.path = opts["path"]
+	if d.path == "" {
+		d.path = "/usr/local/bin/finalize_rescue.bash"
+	}
+	return nil
+}
+
+func (d *scriptDriver) Apply(ctx context.Context, node *IronicNode, rescueUsername string) error {
+	cmd := exec.CommandContext(ctx, d.path, rescueUsername, node.InstanceInfo.RescuePasswordHash)
+	cmd.Stdin = strings.NewReader(node.InstanceInfo.ConfigDrive)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
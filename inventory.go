@@ -0,0 +1,419 @@
+/**
+ * Copyright 2014 Rackspace, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// LOOKUP_PAYLOAD_VERSION is bumped whenever the shape of HardwareInventory
+// changes in a way Ironic's lookup consumer needs to know about. Version 3
+// added CPU, memory, disk, system vendor, boot mode and enriched interface
+// data (IPv4 address, carrier, speed, vendor/product, LLDP) on top of the
+// v2 payload, which reported only interface name and MAC address.
+const LOOKUP_PAYLOAD_VERSION = "3"
+
+type LookupPayload struct {
+	Version   string            `json:"version"`
+	Inventory HardwareInventory `json:"inventory"`
+}
+
+type HardwareInventory struct {
+	CPU          CPUInfo          `json:"cpu"`
+	Memory       MemoryInfo       `json:"memory"`
+	SystemVendor SystemVendorInfo `json:"system_vendor"`
+	BootInfo     BootInfo         `json:"boot_info"`
+	Disks        []BlockDevice    `json:"disks,omitempty"`
+	Interfaces   []InterfaceInfo  `json:"interfaces"`
+}
+
+type CPUInfo struct {
+	Count     int    `json:"count"`
+	ModelName string `json:"model_name"`
+}
+
+type MemoryInfo struct {
+	TotalKB uint64 `json:"total_kb"`
+}
+
+type BlockDevice struct {
+	Name       string `json:"name"`
+	SizeBytes  uint64 `json:"size_bytes"`
+	Vendor     string `json:"vendor,omitempty"`
+	Model      string `json:"model,omitempty"`
+	Rotational bool   `json:"rotational"`
+}
+
+type SystemVendorInfo struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	ProductName  string `json:"product_name,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+}
+
+type BootInfo struct {
+	BootMode string `json:"boot_mode"` // "uefi" or "bios"
+}
+
+// LLDPNeighbor holds the TLVs lldpd reported for one neighbor, keyed by the
+// dotted TLV name lldpctl's keyvalue format uses (e.g. "port.descr").
+type LLDPNeighbor struct {
+	TLVs map[string]string `json:"tlvs"`
+}
+
+type InterfaceInfo struct {
+	Name        string         `json:"name"`
+	MacAddress  string         `json:"mac_address"`
+	IPv4Address string         `json:"ipv4_address,omitempty"`
+	HasCarrier  bool           `json:"has_carrier"`
+	SpeedMbps   int            `json:"speed_mbps,omitempty"`
+	Vendor      string         `json:"vendor,omitempty"`
+	Product     string         `json:"product,omitempty"`
+	LLDP        []LLDPNeighbor `json:"lldp,omitempty"`
+}
+
+// InventoryOptions gates the collectors that are expensive or require
+// optional tooling not present on every rescue image.
+type InventoryOptions struct {
+	CollectDisks bool
+	CollectLLDP  bool
+}
+
+func InterfaceIsDevice(iface net.Interface) (bool, error) {
+	_, err := os.Stat("/sys/class/net/" + iface.Name + "/device")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		} else {
+			return false, err
+		}
+	} else {
+		return true, nil
+	}
+}
+
+func BuildLookupPayload(logger hclog.Logger, opts InventoryOptions) (*LookupPayload, error) {
+	cpu, err := collectCPUInfo()
+	if err != nil {
+		logger.Warn("error collecting CPU info", "error", err)
+	}
+
+	memory, err := collectMemoryInfo()
+	if err != nil {
+		logger.Warn("error collecting memory info", "error", err)
+	}
+
+	systemVendor, err := collectSystemVendor()
+	if err != nil {
+		logger.Warn("error collecting system vendor info", "error", err)
+	}
+
+	bootInfo := collectBootInfo()
+
+	var disks []BlockDevice
+	if opts.CollectDisks {
+		disks, err = collectDisks()
+		if err != nil {
+			logger.Warn("error collecting disk info", "error", err)
+		}
+	}
+
+	interfaceInfos, err := collectInterfaces(logger, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &LookupPayload{
+		Version: LOOKUP_PAYLOAD_VERSION,
+		Inventory: HardwareInventory{
+			CPU:          cpu,
+			Memory:       memory,
+			SystemVendor: systemVendor,
+			BootInfo:     bootInfo,
+			Disks:        disks,
+			Interfaces:   interfaceInfos,
+		},
+	}
+
+	logger.Debug("built lookup payload", "interface_count", len(interfaceInfos), "disk_count", len(disks))
+	return payload, nil
+}
+
+// collectCPUInfo reads /proc/cpuinfo for the number of logical processors
+// and the model name reported for the first one.
+func collectCPUInfo() (CPUInfo, error) {
+	info := CPUInfo{}
+
+	contents, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return info, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		key, value, ok := splitColonField(line)
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "processor":
+			info.Count++
+		case "model name":
+			if info.ModelName == "" {
+				info.ModelName = value
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// collectMemoryInfo reads the MemTotal field out of /proc/meminfo.
+func collectMemoryInfo() (MemoryInfo, error) {
+	info := MemoryInfo{}
+
+	contents, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return info, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		key, value, ok := splitColonField(line)
+		if !ok || key != "MemTotal" {
+			continue
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		totalKB, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return info, err
+		}
+		info.TotalKB = totalKB
+		break
+	}
+
+	return info, nil
+}
+
+// collectSystemVendor reads DMI system identification exposed by the
+// kernel under /sys/class/dmi/id.
+func collectSystemVendor() (SystemVendorInfo, error) {
+	info := SystemVendorInfo{}
+
+	var err error
+	if info.Manufacturer, err = readTrimmedFile("/sys/class/dmi/id/sys_vendor"); err != nil && !os.IsNotExist(err) {
+		return info, err
+	}
+	if info.ProductName, err = readTrimmedFile("/sys/class/dmi/id/product_name"); err != nil && !os.IsNotExist(err) {
+		return info, err
+	}
+	if info.SerialNumber, err = readTrimmedFile("/sys/class/dmi/id/product_serial"); err != nil && !os.IsNotExist(err) {
+		return info, err
+	}
+
+	return info, nil
+}
+
+// collectBootInfo reports whether the running system booted via UEFI, by
+// checking for the efivarfs mount the kernel exposes under /sys/firmware.
+func collectBootInfo() BootInfo {
+	if _, err := os.Stat("/sys/firmware/efi"); err == nil {
+		return BootInfo{BootMode: "uefi"}
+	}
+	return BootInfo{BootMode: "bios"}
+}
+
+// collectDisks enumerates block devices under /sys/block, reading their
+// size and vendor/model/rotational attributes. It is gated behind
+// -collect-disks since it walks every device on the system.
+func collectDisks() ([]BlockDevice, error) {
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+
+	disks := make([]BlockDevice, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		sysPath := "/sys/block/" + name
+
+		sectorsStr, err := readTrimmedFile(sysPath + "/size")
+		if err != nil {
+			continue
+		}
+		sectors, err := strconv.ParseUint(sectorsStr, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		rotationalStr, _ := readTrimmedFile(sysPath + "/queue/rotational")
+		vendor, _ := readTrimmedFile(sysPath + "/device/vendor")
+		model, _ := readTrimmedFile(sysPath + "/device/model")
+
+		disks = append(disks, BlockDevice{
+			Name:       name,
+			SizeBytes:  sectors * 512,
+			Vendor:     vendor,
+			Model:      model,
+			Rotational: rotationalStr == "1",
+		})
+	}
+
+	return disks, nil
+}
+
+// collectInterfaces builds the per-NIC InterfaceInfo list, enriching each
+// physical device with its IPv4 address, carrier state, link speed, and
+// vendor/product strings, plus LLDP neighbor data when requested.
+func collectInterfaces(logger hclog.Logger, opts InventoryOptions) ([]InterfaceInfo, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var lldpByInterface map[string][]LLDPNeighbor
+	if opts.CollectLLDP {
+		lldpByInterface, err = collectLLDP()
+		if err != nil {
+			logger.Warn("error collecting LLDP neighbors", "error", err)
+		}
+	}
+
+	interfaceInfos := make([]InterfaceInfo, 0)
+
+	for _, iface := range interfaces {
+		isDevice, err := InterfaceIsDevice(iface)
+		if err != nil {
+			return nil, err
+		}
+		if !isDevice {
+			continue
+		}
+
+		sysPath := "/sys/class/net/" + iface.Name
+
+		carrierStr, _ := readTrimmedFile(sysPath + "/carrier")
+		speedStr, _ := readTrimmedFile(sysPath + "/speed")
+		speedMbps, _ := strconv.Atoi(speedStr)
+		vendor, _ := readTrimmedFile(sysPath + "/device/vendor")
+		product, _ := readTrimmedFile(sysPath + "/device/device")
+
+		info := InterfaceInfo{
+			Name:        iface.Name,
+			MacAddress:  iface.HardwareAddr.String(),
+			IPv4Address: firstIPv4Address(iface),
+			HasCarrier:  carrierStr == "1",
+			SpeedMbps:   speedMbps,
+			Vendor:      vendor,
+			Product:     product,
+			LLDP:        lldpByInterface[iface.Name],
+		}
+
+		logger.Debug("found network device", "name", info.Name, "mac_address", info.MacAddress, "has_carrier", info.HasCarrier)
+		interfaceInfos = append(interfaceInfos, info)
+	}
+
+	return interfaceInfos, nil
+}
+
+func firstIPv4Address(iface net.Interface) string {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipv4 := ipNet.IP.To4(); ipv4 != nil {
+			return ipv4.String()
+		}
+	}
+
+	return ""
+}
+
+// collectLLDP invokes lldpctl in its "keyvalue" output format and parses
+// lines like "lldp.eth0.chassis.mac=aa:bb:cc:dd:ee:ff" into a map from
+// interface name to its LLDP neighbors' TLVs.
+func collectLLDP() (map[string][]LLDPNeighbor, error) {
+	out, err := exec.Command("lldpctl", "-f", "keyvalue").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	tlvsByInterface := make(map[string]map[string]string)
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+
+		keyAndValue := strings.SplitN(line, "=", 2)
+		if len(keyAndValue) != 2 {
+			continue
+		}
+
+		keyParts := strings.Split(keyAndValue[0], ".")
+		if len(keyParts) < 3 || keyParts[0] != "lldp" {
+			continue
+		}
+
+		ifaceName := keyParts[1]
+		tlvName := strings.Join(keyParts[2:], ".")
+
+		if tlvsByInterface[ifaceName] == nil {
+			tlvsByInterface[ifaceName] = make(map[string]string)
+		}
+		tlvsByInterface[ifaceName][tlvName] = keyAndValue[1]
+	}
+
+	neighborsByInterface := make(map[string][]LLDPNeighbor, len(tlvsByInterface))
+	for ifaceName, tlvs := range tlvsByInterface {
+		neighborsByInterface[ifaceName] = []LLDPNeighbor{{TLVs: tlvs}}
+	}
+
+	return neighborsByInterface, nil
+}
+
+func splitColonField(line string) (key string, value string, ok bool) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+func readTrimmedFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}